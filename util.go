@@ -11,7 +11,11 @@
 package viper
 
 import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -156,6 +160,78 @@ func userHomeDir() string {
 	return os.Getenv("HOME")
 }
 
+// SizeParseError reports why a size string passed to ParseSize could not be
+// interpreted.
+type SizeParseError struct {
+	Input  string
+	Reason string
+}
+
+func (e *SizeParseError) Error() string {
+	return fmt.Sprintf("viper: invalid size %q: %s", e.Input, e.Reason)
+}
+
+// sizeUnits maps a lower-cased unit suffix to the number of bytes it
+// represents. Units ending in "ib" are binary (powers of 1024); units
+// ending in plain "b" are decimal SI units (powers of 1000), except for the
+// bare "b" suffix itself, which is a byte count.
+var sizeUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+	"pib": 1 << 50,
+	"kb":  1000,
+	"mb":  1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"pb":  1000 * 1000 * 1000 * 1000 * 1000,
+}
+
+// ParseSize parses a human-readable byte size such as "1.5GiB", "12MB" or a
+// bare "1024" into the number of bytes it represents. Binary units (KiB,
+// MiB, GiB, TiB, PiB) are powers of 1024; SI units (kB, MB, GB, TB, PB) are
+// powers of 1000, so "1GB" and "1GiB" are distinguishable. ParseSize returns
+// a *SizeParseError for empty input, negative values, unknown suffixes, and
+// values that overflow uint64.
+func ParseSize(sizeStr string) (uint64, error) {
+	trimmed := strings.TrimSpace(sizeStr)
+	if trimmed == "" {
+		return 0, &SizeParseError{Input: sizeStr, Reason: "empty input"}
+	}
+
+	i := 0
+	for i < len(trimmed) && (unicode.IsDigit(rune(trimmed[i])) || trimmed[i] == '.' || trimmed[i] == '-' || trimmed[i] == '+') {
+		i++
+	}
+	numPart := strings.TrimSpace(trimmed[:i])
+	unitPart := strings.ToLower(strings.TrimSpace(trimmed[i:]))
+
+	value, err := strconv.ParseFloat(numPart, 64)
+	if err != nil {
+		return 0, &SizeParseError{Input: sizeStr, Reason: "not a number"}
+	}
+	if value < 0 {
+		return 0, &SizeParseError{Input: sizeStr, Reason: "negative size"}
+	}
+
+	multiplier, ok := sizeUnits[unitPart]
+	if !ok {
+		return 0, &SizeParseError{Input: sizeStr, Reason: fmt.Sprintf("unknown unit %q", unitPart)}
+	}
+
+	bytes := value * multiplier
+	if bytes >= float64(math.MaxUint64) {
+		return 0, &SizeParseError{Input: sizeStr, Reason: "overflow"}
+	}
+
+	return uint64(bytes), nil
+}
+
+// safeMul multiplies a and b, returning 0 on unsigned overflow instead of
+// wrapping around.
 func safeMul(a, b uint) uint {
 	c := a * b
 	if a > 1 && b > 1 && c/b != a {
@@ -164,7 +240,16 @@ func safeMul(a, b uint) uint {
 	return c
 }
 
-// parseSizeInBytes converts strings like 1GB or 12 mb into an unsigned integer number of bytes
+// parseSizeInBytes converts strings like 1GB or 12 mb into an unsigned
+// integer number of bytes. Unlike ParseSize, it treats k/m/g suffixes as
+// binary (1024-based) regardless of an "i", matching the original
+// implementation byte-for-byte: parseSizeInBytes("1GB") == 1<<30, not the
+// 1000-based value ParseSize("1GB") would give. This is deliberate, not an
+// oversight - it is a backward-compatibility shim for existing callers that
+// predate ParseSize's IEC/SI distinction, so their configured limits don't
+// silently shrink by ~7% on upgrade. New code should call ParseSize
+// directly and use "GiB"/"GB" explicitly instead of relying on this
+// legacy-binary interpretation.
 func parseSizeInBytes(sizeStr string) uint {
 	sizeStr = strings.TrimSpace(sizeStr)
 	lastChar := len(sizeStr) - 1
@@ -199,6 +284,26 @@ func parseSizeInBytes(sizeStr string) uint {
 	return safeMul(uint(size), multiplier)
 }
 
+// GetSize looks up key in src using keyDelim-separated path syntax (see
+// WalkPath) and parses the resulting value as a byte size via ParseSize.
+func GetSize(keyDelim string, key string, src map[string]interface{}) (uint64, error) {
+	value := pathFindNoCreate(keyDelim, key, src)
+	if value == nil {
+		return 0, &SizeParseError{Input: key, Reason: "key not found"}
+	}
+	return ParseSize(cast.ToString(value))
+}
+
+// GetSizeDefault behaves like GetSize but returns def instead of an error
+// when key is absent or its value cannot be parsed as a size.
+func GetSizeDefault(keyDelim string, key string, src map[string]interface{}, def uint64) uint64 {
+	size, err := GetSize(keyDelim, key, src)
+	if err != nil {
+		return def
+	}
+	return size
+}
+
 // deepSearch scans deep maps, following the key indexes listed in the
 // sequence "path".
 // The last value is expected to be another map, and is returned.
@@ -249,154 +354,288 @@ func pathFindNoCreate(keyDelim string, key string, src map[string]interface{}) i
 	lcaseKey := strings.ToLower(key)
 	path := strings.Split(lcaseKey, keyDelim)
 
-	lastKey := strings.ToLower(path[len(path)-1])
+	// A trailing empty segment (e.g. "a__b__0__") is the legacy way of
+	// saying "index into an array of primitives"; WalkPath has no use for
+	// the empty segment itself, so drop it.
+	if last := path[len(path)-1]; len(last) == 0 {
+		path = path[:len(path)-1]
+	}
 
-	fmt.Println(lastKey)
-	path = path[0 : len(path)-1]
-	if len(lastKey) == 0 {
-		// we are targeting an array that contains a primitive
-		deepestArray, idx := deepSearchArrayNoCreate(src, path)
-		if deepestArray != nil && idx > -1 {
-			return deepestArray[idx]
-		}
-		return nil
-	} else {
-		deepestMap := deepSearchNoCreate(src, path)
-		if deepestMap != nil {
-			return deepestMap[lastKey]
-		}
+	value, found, err := WalkPath(src, path)
+	if err != nil || !found {
 		return nil
-
 	}
+	return value
 }
 
-// Like deepSearch, but doesn't create anything.  Returns nil if not present
-func deepSearchNoCreate(m map[string]interface{}, path []string) map[string]interface{} {
-	var currentPath string
-	var stepArray bool = false
-	var currentArray []interface{}
-	for _, k := range path {
-		if len(currentPath) == 0 {
-			currentPath = k
-		} else {
-			currentPath = fmt.Sprintf("%v.%v", currentPath, k)
-		}
-		if stepArray {
-			idx, err := strconv.Atoi(k)
-			if err != nil {
-				return nil
-			}
-			if len(currentArray) <= idx {
-				return nil
-			}
-			m3, ok := currentArray[idx].(map[string]interface{})
+// PathError indicates where a WalkPath traversal failed: Index is the
+// position in Path that could not be consumed, and Err describes why.
+type PathError struct {
+	Path  []string
+	Index int
+	Err   error
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("viper: error walking path %v at %q: %s", e.Path, e.Path[e.Index], e.Err)
+}
+
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+// WalkPath traverses src following path, where each segment is either a map
+// key or, wherever an array is encountered, a numeric index into it. It
+// returns the value found at the end of path and whether it was found at
+// all. A missing key or out-of-range index is reported via found == false,
+// err == nil; WalkPath only returns a *PathError when the path itself is
+// malformed, e.g. a non-numeric segment where an array index was expected.
+//
+// WalkPath never creates anything in src. It replaces the unexported
+// deepSearchNoCreate/deepSearchArrayNoCreate pair that used to do this.
+func WalkPath(src map[string]interface{}, path []string) (value interface{}, found bool, err error) {
+	var cur interface{} = src
+	for i, k := range path {
+		switch node := cur.(type) {
+		case map[string]interface{}:
+			v, ok := node[k]
 			if !ok {
-				return nil
+				return nil, false, nil
 			}
-			// continue search from here
-			m = m3
-			stepArray = false // don't support arrays of arrays
-		} else {
-			m2, ok := m[k]
-			if !ok {
-				// intermediate key does not exist
-				return nil
+			cur = v
+		case []interface{}:
+			idx, convErr := strconv.Atoi(k)
+			if convErr != nil {
+				return nil, false, &PathError{Path: path, Index: i, Err: convErr}
 			}
-			m3, ok := m2.(map[string]interface{})
-			if !ok {
-				// is this an array
-				m4, ok := m2.([]interface{})
-				if ok {
-					currentArray = m4
-					stepArray = true
-					m3 = nil
-				} else {
-					// intermediate key is a value
-					return nil
-
-				}
+			if idx < 0 || idx >= len(node) {
+				return nil, false, nil
 			}
-			// continue search from here
-			m = m3
+			cur = node[idx]
+		default:
+			return nil, false, nil
+		}
+	}
+	return cur, true, nil
+}
 
+// ArrayIndexError is returned when an env-variable override addresses an
+// array index that cannot be reconciled with the existing slice, e.g.
+// A__B__5=foo when b only has two elements.
+type ArrayIndexError struct {
+	Path  string
+	Index int
+	Len   int
+}
+
+func (e *ArrayIndexError) Error() string {
+	return fmt.Sprintf("viper: index %d out of range for array %q (len %d)", e.Index, e.Path, e.Len)
+}
+
+// setPath writes value at the location described by path (already split on
+// the key delimiter and lower-cased) within src, creating intermediate maps
+// as deepSearch does. Whenever an intermediate key addresses an array rather
+// than a map, the write is routed through deepSearchArraySet so that array
+// elements - and fields of structs living inside arrays - can be overridden
+// directly, without requiring a trailing delimiter.
+func setPath(src map[string]interface{}, path []string, value interface{}) error {
+	m := src
+	for i := 0; i < len(path)-1; i++ {
+		k := path[i]
+		child, ok := m[k]
+		if !ok {
+			m3 := make(map[string]interface{})
+			m[k] = m3
+			m = m3
+			continue
+		}
+		if arr, ok := child.([]interface{}); ok {
+			arrPath := append(append([]string{}, path[:i]...), k)
+			return deepSearchArraySet(arr, func(newArr []interface{}) { m[k] = newArr }, arrPath, path[i+1:], value)
+		}
+		m3, ok := child.(map[string]interface{})
+		if !ok {
+			m3 = make(map[string]interface{})
+			m[k] = m3
 		}
+		m = m3
 	}
-	return m
+	m[path[len(path)-1]] = value
+	return nil
 }
 
-// Like deepSearch, but doesn't create anything.  Returns nil if not present
-func deepSearchArrayNoCreate(m map[string]interface{}, path []string) ([]interface{}, int) {
-	var currentPath string
-	var stepArray bool = false
-	var currentArray []interface{}
-	var currentIdx int = -1
-	var err error
-	pathDepth := len(path)
-	for currentPathIdx, k := range path {
-		if len(currentPath) == 0 {
-			currentPath = k
+// deepSearchArraySet is the write-side counterpart of WalkPath's array handling.
+// remaining[0] must be a numeric index into arr; arrPath is the path to arr
+// itself (used only to make *ArrayIndexError messages useful). Indexing one
+// past the end of arr appends value (or a fresh container for further
+// traversal); indexing further out of range returns an *ArrayIndexError. If
+// remaining has more elements left after the index, the addressed element
+// must be (or becomes) a map or array and the walk continues recursively, so
+// arrays nested inside arrays are supported.
+func deepSearchArraySet(arr []interface{}, setArr func([]interface{}), arrPath []string, remaining []string, value interface{}) error {
+	idx, err := strconv.Atoi(remaining[0])
+	if err != nil {
+		return fmt.Errorf("viper: %q is not a valid array index", remaining[0])
+	}
+	if idx < 0 || idx > len(arr) {
+		return &ArrayIndexError{Path: strings.Join(arrPath, "."), Index: idx, Len: len(arr)}
+	}
+
+	if len(remaining) == 1 {
+		if idx == len(arr) {
+			arr = append(arr, value)
 		} else {
-			currentPath = fmt.Sprintf("%v.%v", currentPath, k)
+			arr[idx] = value
 		}
-		if stepArray {
-			currentIdx, err = strconv.Atoi(k)
-			if err != nil {
-				return nil, -1
-			}
-			if len(currentArray) <= currentIdx {
-				return nil, -1
-			}
-			m2 := currentArray[currentIdx]
-			stepArray = false
+		setArr(arr)
+		return nil
+	}
 
-			m3, ok := m2.(map[string]interface{})
-			if !ok {
-				// is this an array
-				m4, ok := m2.([]interface{})
-				if ok {
-					currentArray = m4
-					stepArray = true
-					m3 = nil
-				} else {
-					if currentPathIdx == pathDepth-1 {
-						// end of the line
-						continue
-					} else {
-
-						return nil, -1
-					}
+	if idx == len(arr) {
+		arr = append(arr, nil)
+	}
+	switch next := arr[idx].(type) {
+	case []interface{}:
+		nestedPath := append(append([]string{}, arrPath...), remaining[0])
+		return deepSearchArraySet(next, func(newArr []interface{}) { arr[idx] = newArr; setArr(arr) }, nestedPath, remaining[1:], value)
+	case map[string]interface{}:
+		if err := setPath(next, remaining[1:], value); err != nil {
+			return err
+		}
+		setArr(arr)
+		return nil
+	default:
+		m3 := make(map[string]interface{})
+		arr[idx] = m3
+		if err := setPath(m3, remaining[1:], value); err != nil {
+			return err
+		}
+		setArr(arr)
+		return nil
+	}
+}
 
-				}
-			}
-			// continue search from here
-			m = m3
+// applyEnvOverride merges a single raw environment-variable assignment (as
+// produced by getPotentialEnvVariables) into src. If the final path segment
+// matches a suffix registered via RegisterEnvDecoder, the value is decoded
+// and merged at the path with that segment stripped; otherwise the raw
+// string is merged as-is. Either way the write routes through
+// setPath/deepSearchArraySet, so array indices in the path are honored.
+func applyEnvOverride(keyDelim string, envKey string, value string, src map[string]interface{}) error {
+	path := strings.Split(strings.ToLower(envKey), keyDelim)
+
+	// A trailing empty segment (e.g. "a__b__0__") is the legacy way of
+	// saying "index into an array of primitives" (see pathFindNoCreate,
+	// which trims it the same way on the read side); setPath has no use
+	// for the empty segment itself, so drop it before writing.
+	if len(path) > 1 {
+		if last := path[len(path)-1]; len(last) == 0 {
+			path = path[:len(path)-1]
+		}
+	}
 
-		} else {
-			m2, ok := m[k]
-			if !ok {
-				// intermediate key does not exist
-				return nil, -1
+	if len(path) > 1 {
+		if dec, ok := envDecoders[path[len(path)-1]]; ok {
+			decoded, err := dec(value)
+			if err != nil {
+				return fmt.Errorf("viper: decoding %s: %w", envKey, err)
 			}
-			m3, ok := m2.(map[string]interface{})
-			if !ok {
-				// is this an array
-				m4, ok := m2.([]interface{})
-				if ok {
-					currentArray = m4
-					stepArray = true
-					m3 = nil
-				} else {
-					// intermediate key is a value
-					// => replace with a new map
-					m3 = make(map[string]interface{})
-					m[k] = m3
+			return setPath(src, path[:len(path)-1], insensitiviseDecodedValue(decoded))
+		}
+	}
 
-				}
-			}
-			// continue search from here
-			m = m3
+	return setPath(src, path, value)
+}
 
+// insensitiviseDecodedValue is toCaseInsensitiveValue's array-aware counterpart:
+// decoders such as decodeJSONEnv can produce maps nested inside []interface{}
+// (e.g. APP__SERVERS__JSON=[{"Host":"a"}]), so keys need lower-casing inside
+// slice elements too, not just at the top level.
+func insensitiviseDecodedValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		nv := make([]interface{}, len(v))
+		for i, elem := range v {
+			nv[i] = insensitiviseDecodedValue(elem)
+		}
+		return nv
+	case map[interface{}]interface{}:
+		return insensitiviseDecodedValue(cast.ToStringMap(v))
+	case map[string]interface{}:
+		nm := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			nm[strings.ToLower(key)] = insensitiviseDecodedValue(elem)
 		}
+		return nm
+	default:
+		return toCaseInsensitiveValue(v)
+	}
+}
+
+// EnvDecoderFunc decodes a raw environment-variable value into a structured
+// Go value suitable for merging into the config tree.
+type EnvDecoderFunc func(string) (interface{}, error)
+
+// envDecoders holds the decoders available to applyEnvOverride, keyed by the
+// (lower-cased) path segment suffix that selects them, e.g. registering
+// "json" lets APP__SERVERS__JSON=[...] be decoded and merged under
+// app.servers instead of being stored verbatim under app.servers.json.
+var envDecoders = map[string]EnvDecoderFunc{
+	"json": decodeJSONEnv,
+	"csv":  decodeCSVEnv,
+	"b64":  decodeBase64Env,
+	"file": decodeFileEnv,
+}
+
+// RegisterEnvDecoder registers fn to decode the value of any environment
+// variable whose path (after splitting on the key delimiter) ends in suffix.
+// suffix is matched case-insensitively and, once matched, is stripped from
+// the path the decoded value is merged at. Calling RegisterEnvDecoder with
+// one of the built-in suffixes ("json", "csv", "b64", "file") replaces it.
+func RegisterEnvDecoder(suffix string, fn EnvDecoderFunc) {
+	envDecoders[strings.ToLower(suffix)] = fn
+}
+
+// decodeJSONEnv decodes a JSON-encoded env value, e.g.
+// APP__SERVERS__JSON=[{"host":"a"},{"host":"b"}].
+func decodeJSONEnv(raw string) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// decodeCSVEnv decodes a single-line comma-separated env value, e.g.
+// APP__TAGS__CSV=a,b,c, into a []interface{} of strings.
+func decodeCSVEnv(raw string) (interface{}, error) {
+	record, err := csv.NewReader(strings.NewReader(raw)).Read()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(record))
+	for i, s := range record {
+		values[i] = s
+	}
+	return values, nil
+}
+
+// decodeBase64Env decodes a standard-encoding base64 env value, e.g.
+// APP__CERT__B64=..., into the decoded string.
+func decodeBase64Env(raw string) (interface{}, error) {
+	decoded, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, err
+	}
+	return string(decoded), nil
+}
+
+// decodeFileEnv treats the env value as a path and loads its contents, e.g.
+// APP__CERT__FILE=/etc/secrets/tls.crt.
+func decodeFileEnv(raw string) (interface{}, error) {
+	data, err := os.ReadFile(raw)
+	if err != nil {
+		return nil, err
 	}
-	return currentArray, currentIdx
+	return string(data), nil
 }
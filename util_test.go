@@ -0,0 +1,364 @@
+// Copyright © 2014 Steve Francia <spf@spf13.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package viper
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPathFindNoCreateArrayIndexWithoutTrailingDelim(t *testing.T) {
+	src := map[string]interface{}{
+		"b": []interface{}{"zero", "one", "two"},
+	}
+
+	if got := pathFindNoCreate("__", "b__0", src); got != "zero" {
+		t.Fatalf("expected \"zero\", got %v", got)
+	}
+	if got := pathFindNoCreate("__", "b__2", src); got != "two" {
+		t.Fatalf("expected \"two\", got %v", got)
+	}
+	if got := pathFindNoCreate("__", "b__5", src); got != nil {
+		t.Fatalf("expected nil for out-of-range index, got %v", got)
+	}
+}
+
+func TestPathFindNoCreateArrayFieldWithoutTrailingDelim(t *testing.T) {
+	src := map[string]interface{}{
+		"b": []interface{}{
+			map[string]interface{}{"c": "first"},
+			map[string]interface{}{"c": "second"},
+		},
+	}
+
+	if got := pathFindNoCreate("__", "b__1__c", src); got != "second" {
+		t.Fatalf("expected \"second\", got %v", got)
+	}
+}
+
+func TestApplyEnvOverrideScalarArrayIndex(t *testing.T) {
+	src := map[string]interface{}{
+		"b": []interface{}{"zero", "one"},
+	}
+
+	if err := applyEnvOverride("__", "b__0", "replaced", src); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	arr := src["b"].([]interface{})
+	if arr[0] != "replaced" {
+		t.Fatalf("expected index 0 to be replaced, got %v", arr[0])
+	}
+}
+
+func TestApplyEnvOverrideScalarArrayIndexLegacyTrailingDelim(t *testing.T) {
+	src := map[string]interface{}{
+		"b": []interface{}{"zero", "one"},
+	}
+
+	// "b__0__" is the legacy trailing-delimiter form pathFindNoCreate
+	// already accepts for reads; the write path must honor it the same
+	// way instead of creating a nested map at index 0.
+	if err := applyEnvOverride("__", "b__0__", "replaced", src); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	arr := src["b"].([]interface{})
+	if arr[0] != "replaced" {
+		t.Fatalf("expected index 0 to be replaced with \"replaced\", got %#v", arr[0])
+	}
+}
+
+func TestApplyEnvOverrideStructFieldInArray(t *testing.T) {
+	src := map[string]interface{}{
+		"b": []interface{}{
+			map[string]interface{}{"c": "orig"},
+		},
+	}
+
+	if err := applyEnvOverride("__", "b__0__c", "overridden", src); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	arr := src["b"].([]interface{})
+	m := arr[0].(map[string]interface{})
+	if m["c"] != "overridden" {
+		t.Fatalf("expected field c to be overridden, got %v", m["c"])
+	}
+}
+
+func TestApplyEnvOverrideAppendsAtLength(t *testing.T) {
+	src := map[string]interface{}{
+		"b": []interface{}{"zero"},
+	}
+
+	if err := applyEnvOverride("__", "b__1", "one", src); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	arr := src["b"].([]interface{})
+	if len(arr) != 2 || arr[1] != "one" {
+		t.Fatalf("expected append at index 1, got %v", arr)
+	}
+}
+
+func TestApplyEnvOverrideOutOfRangeErrors(t *testing.T) {
+	src := map[string]interface{}{
+		"b": []interface{}{"zero"},
+	}
+
+	err := applyEnvOverride("__", "b__5", "nope", src)
+	if err == nil {
+		t.Fatal("expected an error for out-of-range index")
+	}
+	arrErr, ok := err.(*ArrayIndexError)
+	if !ok {
+		t.Fatalf("expected *ArrayIndexError, got %T: %v", err, err)
+	}
+	if arrErr.Path != "b" {
+		t.Fatalf("expected Path %q to name the array being indexed, got %q", "b", arrErr.Path)
+	}
+	if arrErr.Index != 5 {
+		t.Fatalf("expected Index 5, got %d", arrErr.Index)
+	}
+}
+
+func TestApplyEnvOverrideOutOfRangeErrorPathForNestedArray(t *testing.T) {
+	src := map[string]interface{}{
+		"b": []interface{}{
+			[]interface{}{"a"},
+		},
+	}
+
+	err := applyEnvOverride("__", "b__0__9", "nope", src)
+	arrErr, ok := err.(*ArrayIndexError)
+	if !ok {
+		t.Fatalf("expected *ArrayIndexError, got %T: %v", err, err)
+	}
+	if arrErr.Path != "b.0" {
+		t.Fatalf("expected Path %q, got %q", "b.0", arrErr.Path)
+	}
+}
+
+func TestApplyEnvOverrideTypeMismatchIsAllowed(t *testing.T) {
+	src := map[string]interface{}{
+		"b": []interface{}{1, 2, 3},
+	}
+
+	if err := applyEnvOverride("__", "b__1", "two", src); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	arr := src["b"].([]interface{})
+	if arr[1] != "two" {
+		t.Fatalf("expected string override of int element, got %v (%T)", arr[1], arr[1])
+	}
+}
+
+func TestParseSizeBinaryAndDecimalUnits(t *testing.T) {
+	cases := map[string]uint64{
+		"1GiB":   1 << 30,
+		"1GB":    1000 * 1000 * 1000,
+		"1.5GiB": uint64(1.5 * (1 << 30)),
+		"12MB":   12 * 1000 * 1000,
+		"1024":   1024,
+		"1 KiB":  1 << 10,
+	}
+
+	for input, want := range cases {
+		got, err := ParseSize(input)
+		if err != nil {
+			t.Fatalf("ParseSize(%q) returned error: %v", input, err)
+		}
+		if got != want {
+			t.Errorf("ParseSize(%q) = %d, want %d", input, got, want)
+		}
+	}
+}
+
+func TestParseSizeErrors(t *testing.T) {
+	cases := []string{"", "-1GiB", "1XB", "garbage"}
+
+	for _, input := range cases {
+		if _, err := ParseSize(input); err == nil {
+			t.Errorf("ParseSize(%q) expected error, got nil", input)
+		} else if _, ok := err.(*SizeParseError); !ok {
+			t.Errorf("ParseSize(%q) expected *SizeParseError, got %T", input, err)
+		}
+	}
+}
+
+func TestParseSizeOverflow(t *testing.T) {
+	if _, err := ParseSize("100000000000PiB"); err == nil {
+		t.Fatal("expected overflow error")
+	}
+}
+
+// parseSizeInBytes intentionally diverges from ParseSize: it treats k/m/g
+// suffixes as binary (1024-based), matching the pre-ParseSize implementation
+// byte-for-byte, so existing callers configuring e.g. "10GB" limits don't
+// silently get ~7% smaller values after ParseSize's IEC/SI split landed.
+func TestParseSizeInBytesLegacyBinaryUnits(t *testing.T) {
+	cases := map[string]uint{
+		"1GB":   1 << 30,
+		"12mb":  12 * (1 << 20),
+		"1kb":   1 << 10,
+		"1024":  1024,
+		"1024b": 1024,
+	}
+	for input, want := range cases {
+		if got := parseSizeInBytes(input); got != want {
+			t.Errorf("parseSizeInBytes(%q) = %d, want %d", input, got, want)
+		}
+	}
+
+	// ParseSize treats "GB" as decimal (1e9); parseSizeInBytes must not.
+	if got := parseSizeInBytes("1GB"); got == 1000*1000*1000 {
+		t.Errorf("parseSizeInBytes(\"1GB\") returned ParseSize's decimal value %d instead of the legacy binary value", got)
+	}
+}
+
+func TestParseSizeInBytesErrors(t *testing.T) {
+	if got := parseSizeInBytes("garbage"); got != 0 {
+		t.Errorf("parseSizeInBytes(\"garbage\") = %d, want 0", got)
+	}
+	if got := parseSizeInBytes("-1GB"); got != 0 {
+		t.Errorf("parseSizeInBytes(\"-1GB\") = %d, want 0", got)
+	}
+}
+
+func TestGetSizeAndGetSizeDefault(t *testing.T) {
+	src := map[string]interface{}{"cache": map[string]interface{}{"limit": "2GiB"}}
+
+	size, err := GetSize("__", "cache__limit", src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if size != 2<<30 {
+		t.Errorf("GetSize = %d, want %d", size, uint64(2<<30))
+	}
+
+	if got := GetSizeDefault("__", "cache__missing", src, 42); got != 42 {
+		t.Errorf("GetSizeDefault = %d, want 42", got)
+	}
+}
+
+func TestWalkPathMapsAndArrays(t *testing.T) {
+	src := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": []interface{}{
+				map[string]interface{}{"c": "found"},
+			},
+		},
+	}
+
+	value, found, err := WalkPath(src, []string{"a", "b", "0", "c"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !found || value != "found" {
+		t.Fatalf("expected (\"found\", true), got (%v, %v)", value, found)
+	}
+}
+
+func TestWalkPathMissingKeyNotFound(t *testing.T) {
+	src := map[string]interface{}{"a": map[string]interface{}{}}
+
+	value, found, err := WalkPath(src, []string{"a", "missing"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if found || value != nil {
+		t.Fatalf("expected (nil, false), got (%v, %v)", value, found)
+	}
+}
+
+func TestWalkPathNonNumericArrayIndexIsPathError(t *testing.T) {
+	src := map[string]interface{}{"a": []interface{}{"x"}}
+
+	_, found, err := WalkPath(src, []string{"a", "notanumber"})
+	if found {
+		t.Fatal("expected found == false")
+	}
+	pathErr, ok := err.(*PathError)
+	if !ok {
+		t.Fatalf("expected *PathError, got %T: %v", err, err)
+	}
+	if pathErr.Index != 1 {
+		t.Fatalf("expected Index 1, got %d", pathErr.Index)
+	}
+}
+
+func TestApplyEnvOverrideJSONDecoder(t *testing.T) {
+	src := map[string]interface{}{}
+
+	err := applyEnvOverride("__", "APP__SERVERS__JSON", `[{"Host":"a"},{"Host":"b"}]`, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	app := src["app"].(map[string]interface{})
+	servers := app["servers"].([]interface{})
+	if len(servers) != 2 {
+		t.Fatalf("expected 2 servers, got %d", len(servers))
+	}
+	first := servers[0].(map[string]interface{})
+	if first["host"] != "a" {
+		t.Fatalf("expected lower-cased key \"host\", got %v", first)
+	}
+}
+
+func TestApplyEnvOverrideCSVDecoder(t *testing.T) {
+	src := map[string]interface{}{}
+
+	if err := applyEnvOverride("__", "APP__TAGS__CSV", "a,b,c", src); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	app := src["app"].(map[string]interface{})
+	tags := app["tags"].([]interface{})
+	if len(tags) != 3 || tags[0] != "a" || tags[2] != "c" {
+		t.Fatalf("unexpected tags: %v", tags)
+	}
+}
+
+func TestApplyEnvOverrideBase64Decoder(t *testing.T) {
+	src := map[string]interface{}{}
+
+	if err := applyEnvOverride("__", "APP__SECRET__B64", "aGVsbG8=", src); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	app := src["app"].(map[string]interface{})
+	if app["secret"] != "hello" {
+		t.Fatalf("expected decoded secret \"hello\", got %v", app["secret"])
+	}
+}
+
+func TestRegisterEnvDecoderCustomSuffix(t *testing.T) {
+	RegisterEnvDecoder("upper", func(raw string) (interface{}, error) {
+		return strings.ToUpper(raw), nil
+	})
+
+	src := map[string]interface{}{}
+	if err := applyEnvOverride("__", "APP__NAME__UPPER", "viper", src); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	app := src["app"].(map[string]interface{})
+	if app["name"] != "VIPER" {
+		t.Fatalf("expected \"VIPER\", got %v", app["name"])
+	}
+}
+
+func TestApplyEnvOverrideNestedArrays(t *testing.T) {
+	src := map[string]interface{}{
+		"b": []interface{}{
+			[]interface{}{"a", "b"},
+			[]interface{}{"c", "d"},
+		},
+	}
+
+	if err := applyEnvOverride("__", "b__1__0", "z", src); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	outer := src["b"].([]interface{})
+	inner := outer[1].([]interface{})
+	if inner[0] != "z" {
+		t.Fatalf("expected nested array element overridden, got %v", inner[0])
+	}
+}